@@ -0,0 +1,152 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/apprenda/kismatic/pkg/install"
+)
+
+// writeBackendConfig renders backend into clusterStateDir/backend.tf so that
+// Provision and Destroy agree on where a cluster's state lives. An empty
+// rendering (the local backend) removes any stale backend.tf left over from
+// a previous run that used a remote backend.
+func writeBackendConfig(clusterStateDir, clusterName string, backend install.StateBackend) error {
+	hcl, err := stateBackendFromPlan(backend).Render(clusterName)
+	if err != nil {
+		return fmt.Errorf("error rendering state backend configuration: %v", err)
+	}
+	backendFile := filepath.Join(clusterStateDir, "backend.tf")
+	if hcl == "" {
+		if err := os.Remove(backendFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing stale backend.tf: %v", err)
+		}
+		return nil
+	}
+	if err := ioutil.WriteFile(backendFile, []byte(hcl), 0644); err != nil {
+		return fmt.Errorf("error writing backend.tf: %v", err)
+	}
+	return nil
+}
+
+// StateBackend renders the Terraform backend configuration used to store a
+// cluster's state. Provision writes the result to backend.tf before running
+// `terraform init`, so that concurrent operators running `kismatic apply`
+// against the same cluster share state and locking instead of stepping on
+// each other's local terraform.tfstate.
+type StateBackend interface {
+	// Render returns the contents of the `terraform { backend "..." {} }`
+	// block to write into clusterStateDir/backend.tf.
+	Render(clusterName string) (string, error)
+}
+
+// LocalStateBackend keeps terraform.tfstate on disk under StateDir, matching
+// AnyTerraform's original behavior. It is the default when Plan.Provisioner.Backend
+// is not set.
+type LocalStateBackend struct{}
+
+// Render returns an empty string: the absence of a backend.tf means Terraform
+// falls back to its own local backend.
+func (LocalStateBackend) Render(clusterName string) (string, error) {
+	return "", nil
+}
+
+// S3StateBackend stores state in an S3 bucket, with locking provided by a
+// DynamoDB table.
+type S3StateBackend struct {
+	Bucket        string
+	Key           string
+	Region        string
+	DynamoDBTable string
+	ProfileName   string
+}
+
+// Render returns an `s3` backend block keyed by clusterName, so each cluster
+// gets its own object in the shared bucket.
+func (b S3StateBackend) Render(clusterName string) (string, error) {
+	if b.Bucket == "" {
+		return "", fmt.Errorf("s3 state backend requires a bucket")
+	}
+	key := b.Key
+	if key == "" {
+		key = fmt.Sprintf("kismatic/%s/terraform.tfstate", clusterName)
+	}
+	return fmt.Sprintf(`terraform {
+  backend "s3" {
+    bucket         = %q
+    key            = %q
+    region         = %q
+    dynamodb_table = %q
+    profile        = %q
+  }
+}
+`, b.Bucket, key, b.Region, b.DynamoDBTable, b.ProfileName), nil
+}
+
+// ConsulStateBackend stores state in a Consul KV tree. Consul backends lock
+// natively via Consul's session API, so no separate locking table is needed.
+type ConsulStateBackend struct {
+	Address string
+	Path    string
+}
+
+// Render returns a `consul` backend block rooted at a per-cluster path.
+func (b ConsulStateBackend) Render(clusterName string) (string, error) {
+	if b.Address == "" {
+		return "", fmt.Errorf("consul state backend requires an address")
+	}
+	path := b.Path
+	if path == "" {
+		path = fmt.Sprintf("kismatic/%s", clusterName)
+	}
+	return fmt.Sprintf(`terraform {
+  backend "consul" {
+    address = %q
+    path    = %q
+  }
+}
+`, b.Address, path), nil
+}
+
+// stateBackendFromPlan selects the StateBackend implementation configured in
+// plan.Provisioner.Backend, defaulting to LocalStateBackend when the cluster
+// operator hasn't opted into remote state.
+func stateBackendFromPlan(backend install.StateBackend) StateBackend {
+	switch backend.Type {
+	case install.S3Backend:
+		return S3StateBackend{
+			Bucket:        backend.S3.Bucket,
+			Key:           backend.S3.Key,
+			Region:        backend.S3.Region,
+			DynamoDBTable: backend.S3.DynamoDBTable,
+			ProfileName:   backend.S3.Profile,
+		}
+	case install.ConsulBackend:
+		return ConsulStateBackend{
+			Address: backend.Consul.Address,
+			Path:    backend.Consul.Path,
+		}
+	default:
+		return LocalStateBackend{}
+	}
+}
+
+// SecretsStore persists the SSH key material AnyTerraform generates for a
+// cluster. Unlike SecretsGetter (which reads provider API credentials the
+// operator already owns), SecretsStore owns the key's lifecycle: it is
+// written once by whichever operator first provisions the cluster, and read
+// by every operator that provisions or destroys it afterwards.
+type SecretsStore interface {
+	// Put stores data under name, scoped to clusterName. It must be safe to
+	// call when an identical value is already stored.
+	Put(ctx context.Context, clusterName, name string, data []byte) error
+	// Get retrieves data previously stored under name for clusterName. When
+	// nothing is stored yet, it returns an error matched by
+	// errors.Is(err, os.ErrNotExist) rather than os.IsNotExist, since the
+	// latter only recognizes *PathError-shaped errors and stores backed by
+	// something other than the filesystem can't produce one of those.
+	Get(ctx context.Context, clusterName, name string) ([]byte, error)
+}
@@ -0,0 +1,250 @@
+package provision
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	tfjson "github.com/hashicorp/terraform-json"
+)
+
+// ProvisionHook is notified at each stage of a Provision/Plan/Apply/Destroy
+// run. It replaces the single Output io.Writer AnyTerraform used to expose
+// Terraform's human-readable log: a CLI hook can render a live progress bar
+// keyed on planned resource addresses, and an audit hook can record a JSONL
+// trail of every change, without either one having to scrape log text.
+type ProvisionHook interface {
+	PreInit()
+	// InitOutput is called once per non-empty line of `terraform init`'s own
+	// human-readable output (provider download progress, lockfile updates,
+	// diagnostics on failure, ...). Init has no -json mode in Terraform, so
+	// unlike the other lifecycle stages this hook receives raw text instead
+	// of a structured event.
+	InitOutput(line string)
+	PostInit()
+	PrePlan()
+	PostPlan(plan *tfjson.Plan)
+	PreApply()
+	ResourceApplied(addr, action string, elapsed time.Duration)
+	PostApply()
+	PreDestroy()
+	PostDestroy()
+	Diagnostic(severity, summary, detail string)
+}
+
+// NoopProvisionHook implements ProvisionHook with no-op methods. Hooks that
+// only care about part of the lifecycle can embed it and override just the
+// methods they need.
+type NoopProvisionHook struct{}
+
+func (NoopProvisionHook) PreInit()                                             {}
+func (NoopProvisionHook) InitOutput(line string)                               {}
+func (NoopProvisionHook) PostInit()                                            {}
+func (NoopProvisionHook) PrePlan()                                             {}
+func (NoopProvisionHook) PostPlan(*tfjson.Plan)                                {}
+func (NoopProvisionHook) PreApply()                                            {}
+func (NoopProvisionHook) ResourceApplied(addr, action string, _ time.Duration) {}
+func (NoopProvisionHook) PostApply()                                           {}
+func (NoopProvisionHook) PreDestroy()                                          {}
+func (NoopProvisionHook) PostDestroy()                                         {}
+func (NoopProvisionHook) Diagnostic(severity, summary, detail string)          {}
+
+// MultiHook fans a single lifecycle event out to every hook it contains, in order.
+type MultiHook []ProvisionHook
+
+func (m MultiHook) PreInit() {
+	for _, h := range m {
+		h.PreInit()
+	}
+}
+
+func (m MultiHook) InitOutput(line string) {
+	for _, h := range m {
+		h.InitOutput(line)
+	}
+}
+
+func (m MultiHook) PostInit() {
+	for _, h := range m {
+		h.PostInit()
+	}
+}
+
+func (m MultiHook) PrePlan() {
+	for _, h := range m {
+		h.PrePlan()
+	}
+}
+
+func (m MultiHook) PostPlan(plan *tfjson.Plan) {
+	for _, h := range m {
+		h.PostPlan(plan)
+	}
+}
+
+func (m MultiHook) PreApply() {
+	for _, h := range m {
+		h.PreApply()
+	}
+}
+
+func (m MultiHook) ResourceApplied(addr, action string, elapsed time.Duration) {
+	for _, h := range m {
+		h.ResourceApplied(addr, action, elapsed)
+	}
+}
+
+func (m MultiHook) PostApply() {
+	for _, h := range m {
+		h.PostApply()
+	}
+}
+
+func (m MultiHook) PreDestroy() {
+	for _, h := range m {
+		h.PreDestroy()
+	}
+}
+
+func (m MultiHook) PostDestroy() {
+	for _, h := range m {
+		h.PostDestroy()
+	}
+}
+
+func (m MultiHook) Diagnostic(severity, summary, detail string) {
+	for _, h := range m {
+		h.Diagnostic(severity, summary, detail)
+	}
+}
+
+// AuditHook appends a JSONL trail of every create/update/destroy to Path,
+// with timestamps, so that changes made via `kismatic apply` can be
+// reconstructed after the fact.
+type AuditHook struct {
+	NoopProvisionHook
+	Path string
+}
+
+type auditEntry struct {
+	Time      string `json:"time"`
+	Address   string `json:"address"`
+	Action    string `json:"action"`
+	ElapsedMS int64  `json:"elapsed_ms"`
+}
+
+// ResourceApplied records one line of the audit trail per resource change.
+// Write failures are not fatal to provisioning; the hook only logs them.
+func (a AuditHook) ResourceApplied(addr, action string, elapsed time.Duration) {
+	entry := auditEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Address:   addr,
+		Action:    action,
+		ElapsedMS: elapsed.Milliseconds(),
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	f, err := os.OpenFile(a.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "audit hook: error opening %s: %v\n", a.Path, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		fmt.Fprintf(os.Stderr, "audit hook: error writing %s: %v\n", a.Path, err)
+	}
+}
+
+// hook returns at.Hook, defaulting to an empty MultiHook so call sites never
+// need a nil check.
+func (at AnyTerraform) hook() ProvisionHook {
+	if at.Hook != nil {
+		return at.Hook
+	}
+	return MultiHook{}
+}
+
+// tfJSONLogWriter decodes Terraform's `-json` machine-readable log stream
+// (one JSON object per line, available since Terraform 0.12) and dispatches
+// per-resource and diagnostic events to a ProvisionHook as they arrive.
+type tfJSONLogWriter struct {
+	hook ProvisionHook
+	buf  []byte
+}
+
+func (w *tfJSONLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf[:i]
+		w.buf = w.buf[i+1:]
+		w.handleLine(line)
+	}
+	return len(p), nil
+}
+
+func (w *tfJSONLogWriter) handleLine(line []byte) {
+	var msg struct {
+		Type string `json:"type"`
+		Hook struct {
+			Resource struct {
+				Addr string `json:"addr"`
+			} `json:"resource"`
+			Action         string  `json:"action"`
+			ElapsedSeconds float64 `json:"elapsed_seconds"`
+		} `json:"hook"`
+		Diagnostic struct {
+			Severity string `json:"severity"`
+			Summary  string `json:"summary"`
+			Detail   string `json:"detail"`
+		} `json:"diagnostic"`
+	}
+	// Lines Terraform doesn't tag as JSON (e.g. a binary crashed before
+	// switching into -json mode) are ignored rather than surfaced as errors.
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return
+	}
+	switch msg.Type {
+	case "apply_complete":
+		elapsed := time.Duration(msg.Hook.ElapsedSeconds * float64(time.Second))
+		w.hook.ResourceApplied(msg.Hook.Resource.Addr, msg.Hook.Action, elapsed)
+	case "diagnostic":
+		w.hook.Diagnostic(msg.Diagnostic.Severity, msg.Diagnostic.Summary, msg.Diagnostic.Detail)
+	}
+}
+
+var _ io.Writer = &tfJSONLogWriter{}
+
+// initLogWriter forwards each non-empty line of `terraform init`'s output to a
+// ProvisionHook's InitOutput method. Unlike Plan/Apply/Destroy, Init has no
+// -json mode, so there's no structured event to parse here.
+type initLogWriter struct {
+	hook ProvisionHook
+	buf  []byte
+}
+
+func (w *initLogWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			w.hook.InitOutput(line)
+		}
+	}
+	return len(p), nil
+}
+
+var _ io.Writer = &initLogWriter{}
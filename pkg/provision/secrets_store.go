@@ -0,0 +1,185 @@
+package provision
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	smtypes "github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	vaultapi "github.com/hashicorp/vault/api"
+)
+
+// LocalSecretsStore writes secrets as files under Dir/<clusterName>/<name>,
+// preserving AnyTerraform's original on-disk key layout. It is the default
+// SecretsStore, and offers no protection against two operators provisioning
+// the same cluster concurrently.
+type LocalSecretsStore struct {
+	Dir string
+}
+
+// Put writes data to Dir/clusterName/name, creating parent directories as needed.
+func (s LocalSecretsStore) Put(ctx context.Context, clusterName, name string, data []byte) error {
+	dir := filepath.Join(s.Dir, clusterName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating secrets directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+		return fmt.Errorf("error writing secret %q: %v", name, err)
+	}
+	return nil
+}
+
+// Get reads data from Dir/clusterName/name.
+func (s LocalSecretsStore) Get(ctx context.Context, clusterName, name string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.Dir, clusterName, name))
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// AWSSecretsManagerStore stores secrets as AWS Secrets Manager entries named
+// "kismatic/<clusterName>/<name>", letting a team share one cluster's SSH
+// keys without checking them into shared disk.
+type AWSSecretsManagerStore struct {
+	Region  string
+	Profile string
+}
+
+func (s AWSSecretsManagerStore) secretID(clusterName, name string) string {
+	return fmt.Sprintf("kismatic/%s/%s", clusterName, name)
+}
+
+func (s AWSSecretsManagerStore) client(ctx context.Context) (*secretsmanager.Client, error) {
+	var opts []func(*config.LoadOptions) error
+	if s.Region != "" {
+		opts = append(opts, config.WithRegion(s.Region))
+	}
+	if s.Profile != "" {
+		opts = append(opts, config.WithSharedConfigProfile(s.Profile))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS configuration: %v", err)
+	}
+	return secretsmanager.NewFromConfig(cfg), nil
+}
+
+// Put creates or updates the secret value in AWS Secrets Manager.
+func (s AWSSecretsManagerStore) Put(ctx context.Context, clusterName, name string, data []byte) error {
+	client, err := s.client(ctx)
+	if err != nil {
+		return err
+	}
+	id := s.secretID(clusterName, name)
+	_, err = client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(id),
+		SecretBinary: data,
+	})
+	var notFound *smtypes.ResourceNotFoundException
+	if errors.As(err, &notFound) {
+		_, err = client.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+			Name:         aws.String(id),
+			SecretBinary: data,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("error storing secret %q in AWS Secrets Manager: %v", id, err)
+	}
+	return nil
+}
+
+// Get retrieves the secret value from AWS Secrets Manager. A missing secret
+// is reported as an error matched by errors.Is(err, os.ErrNotExist), per the
+// SecretsStore contract.
+func (s AWSSecretsManagerStore) Get(ctx context.Context, clusterName, name string) ([]byte, error) {
+	client, err := s.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id := s.secretID(clusterName, name)
+	out, err := client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+	if err != nil {
+		var notFound *smtypes.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return nil, fmt.Errorf("secret %q: %w", id, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("error retrieving secret %q from AWS Secrets Manager: %v", id, err)
+	}
+	return out.SecretBinary, nil
+}
+
+// VaultSecretsStore stores secrets under a HashiCorp Vault KV mount, keyed by
+// "<MountPath>/<clusterName>/<name>".
+type VaultSecretsStore struct {
+	Address   string
+	MountPath string
+}
+
+func (s VaultSecretsStore) secretPath(clusterName, name string) string {
+	return fmt.Sprintf("%s/%s/%s", s.MountPath, clusterName, name)
+}
+
+func (s VaultSecretsStore) client() (*vaultapi.Client, error) {
+	cfg := vaultapi.DefaultConfig()
+	if s.Address != "" {
+		cfg.Address = s.Address
+	}
+	client, err := vaultapi.NewClient(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault client: %v", err)
+	}
+	return client, nil
+}
+
+// Put writes the secret value to Vault, base64-encoded since Vault's KV
+// engines store string values.
+func (s VaultSecretsStore) Put(ctx context.Context, clusterName, name string, data []byte) error {
+	client, err := s.client()
+	if err != nil {
+		return err
+	}
+	path := s.secretPath(clusterName, name)
+	_, err = client.Logical().WriteWithContext(ctx, path, map[string]interface{}{
+		"value": base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		return fmt.Errorf("error writing secret %q to vault: %v", path, err)
+	}
+	return nil
+}
+
+// Get reads the secret value from Vault. A missing secret is reported as an
+// error matched by errors.Is(err, os.ErrNotExist), per the SecretsStore
+// contract: Vault's Logical().Read returns a nil secret rather than an error
+// when nothing is stored at path.
+func (s VaultSecretsStore) Get(ctx context.Context, clusterName, name string) ([]byte, error) {
+	client, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	path := s.secretPath(clusterName, name)
+	secret, err := client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading secret %q from vault: %v", path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, fmt.Errorf("secret %q: %w", path, os.ErrNotExist)
+	}
+	encoded, ok := secret.Data["value"].(string)
+	if !ok {
+		return nil, fmt.Errorf("secret %q: unexpected vault response shape", path)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("secret %q: error decoding vault response: %v", path, err)
+	}
+	return decoded, nil
+}
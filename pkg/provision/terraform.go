@@ -1,22 +1,35 @@
 package provision
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
 
 	"github.com/apprenda/kismatic/pkg/install"
 	"github.com/apprenda/kismatic/pkg/ssh"
+	"github.com/hashicorp/go-version"
+	"github.com/hashicorp/hc-install/product"
+	"github.com/hashicorp/hc-install/releases"
+	"github.com/hashicorp/terraform-exec/tfexec"
+	tfjson "github.com/hashicorp/terraform-json"
 	yaml "gopkg.in/yaml.v2"
 )
 
 const providerDescriptorFilename = "provider.yaml"
 
+// minTerraformVersion is the oldest Terraform release AnyTerraform has been
+// validated against. Older binaries are rejected before we attempt to use them,
+// since tfexec relies on the -json plan/show output introduced in 0.12.
+var minTerraformVersion = version.Must(version.NewVersion("0.12.0"))
+
+// pinnedTerraformVersion is the version installed by TerraformInstaller when
+// BinaryPath is left empty.
+const pinnedTerraformVersion = "1.5.7"
+
 // The AnyTerraform provisioner uses Terraform to provision infrastructure using
 // providers that adhere to the KET provisioner spec.
 type AnyTerraform struct {
@@ -25,8 +38,24 @@ type AnyTerraform struct {
 	ProvidersDir    string
 	StateDir        string
 	BinaryPath      string
-	Output          io.Writer
 	SecretsGetter   SecretsGetter
+	// SecretsStore persists the SSH key material generated for a cluster.
+	// Defaults to a LocalSecretsStore rooted at StateDir when nil, matching
+	// AnyTerraform's original on-disk behavior.
+	SecretsStore SecretsStore
+	// Hook receives provisioning lifecycle events. Defaults to an empty
+	// MultiHook when nil, so Terraform's own log stream is parsed but
+	// otherwise discarded.
+	Hook ProvisionHook
+}
+
+// secretsStore returns at.SecretsStore, defaulting to a LocalSecretsStore
+// rooted at StateDir when the operator hasn't configured a shared store.
+func (at AnyTerraform) secretsStore() SecretsStore {
+	if at.SecretsStore != nil {
+		return at.SecretsStore
+	}
+	return LocalSecretsStore{Dir: at.StateDir}
 }
 
 // The SecretsGetter provides secrets required when interacting with cloud provider APIs.
@@ -34,6 +63,34 @@ type SecretsGetter interface {
 	GetAsEnvironmentVariables(clusterName string, expectedEnvVars map[string]string) ([]string, error)
 }
 
+// TerraformInstaller resolves a Terraform binary to use by downloading a pinned
+// release via hc-install into InstallDir. This lets users run kismatic without
+// pre-installing Terraform themselves.
+type TerraformInstaller struct {
+	Version    string
+	InstallDir string
+}
+
+// Ensure installs i.Version (or pinnedTerraformVersion if unset) into
+// i.InstallDir and returns the path to the installed binary. It downloads the
+// release on every call; a binary already present in i.InstallDir is not reused.
+func (i TerraformInstaller) Ensure(ctx context.Context) (string, error) {
+	v := i.Version
+	if v == "" {
+		v = pinnedTerraformVersion
+	}
+	installer := &releases.ExactVersion{
+		Product:    product.Terraform,
+		Version:    version.Must(version.NewVersion(v)),
+		InstallDir: i.InstallDir,
+	}
+	execPath, err := installer.Install(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error installing terraform %s: %v", v, err)
+	}
+	return execPath, nil
+}
+
 type provider struct {
 	Description          string            `yaml:"description"`
 	EnvironmentVariables map[string]string `yaml:"environmentVariables"`
@@ -65,19 +122,150 @@ func readProviderDescriptor(providerDir string) (*provider, error) {
 	return &p, nil
 }
 
-// Provision creates the infrastructure required to support the cluster defined
-// in the plan
-func (at AnyTerraform) Provision(plan install.Plan) (*install.Plan, error) {
-	providerName := plan.Provisioner.Provider
-	providerDir := filepath.Join(at.ProvidersDir, providerName)
-	if _, err := os.Stat(providerDir); os.IsNotExist(err) {
-		return nil, fmt.Errorf("provider %q is not supported", providerName)
+// writeInlineModule materializes the HCL supplied in plan.Provisioner.Inline
+// into clusterStateDir so that a plain `terraform init` picks it up, letting
+// operators define a one-off provider without forking ProvidersDir.
+func writeInlineModule(clusterStateDir string, inline install.InlineModule) error {
+	files := map[string]string{
+		"main.tf": inline.Main,
+	}
+	if inline.Variables != "" {
+		files["variables.tf"] = inline.Variables
 	}
+	if inline.Outputs != "" {
+		files["outputs.tf"] = inline.Outputs
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(clusterStateDir, name), []byte(contents), 0644); err != nil {
+			return fmt.Errorf("error writing inline module file %q: %v", name, err)
+		}
+	}
+	return nil
+}
 
-	p, err := readProviderDescriptor(providerDir)
+// newTerraformClient returns a tfexec.Terraform handle rooted at workingDir,
+// resolving at.BinaryPath via TerraformInstaller when it is not set.
+func (at AnyTerraform) newTerraformClient(ctx context.Context, workingDir string) (*tfexec.Terraform, error) {
+	execPath := at.BinaryPath
+	if execPath == "" {
+		installer := TerraformInstaller{InstallDir: at.StateDir}
+		p, err := installer.Ensure(ctx)
+		if err != nil {
+			return nil, err
+		}
+		execPath = p
+	}
+	tf, err := tfexec.NewTerraform(workingDir, execPath)
+	if err != nil {
+		return nil, fmt.Errorf("error creating terraform client: %v", err)
+	}
+	tfVersion, _, err := tf.Version(ctx, false)
+	if err != nil {
+		return nil, fmt.Errorf("error determining terraform version at %q: %v", execPath, err)
+	}
+	if tfVersion.LessThan(minTerraformVersion) {
+		return nil, fmt.Errorf("terraform %s is required, but %q reports %s", minTerraformVersion, execPath, tfVersion)
+	}
+	return tf, nil
+}
+
+// jsonLogWriter returns a writer that decodes Terraform's `-json` log stream
+// and dispatches events to at.hook(). Callers must pass it to one of the
+// ...JSON tfexec methods (PlanJSON, ApplyJSON, DestroyJSON), which are the
+// only ones that actually request -json output from Terraform; SetStdout
+// would otherwise receive human-readable text the writer can't parse.
+func (at AnyTerraform) jsonLogWriter() *tfJSONLogWriter {
+	return &tfJSONLogWriter{hook: at.hook()}
+}
+
+// initLogWriter returns a writer that forwards terraform init's own output,
+// line by line, to at.hook().InitOutput. Unlike jsonLogWriter it must be
+// attached via SetStdout/SetStderr, since Init has no -json mode to request.
+func (at AnyTerraform) initLogWriter() *initLogWriter {
+	return &initLogWriter{hook: at.hook()}
+}
+
+// ProvisionPlan is the result of running `terraform plan` for a cluster: the
+// structured resource diff Terraform computed, plus everything Apply needs to
+// turn that plan into real infrastructure without recomputing it.
+type ProvisionPlan struct {
+	// TFPlan is the parsed `terraform show -json` output for the saved plan
+	// file, giving per-resource add/change/destroy actions.
+	TFPlan *tfjson.Plan
+	// Projected is the install.Plan that would result from applying TFPlan,
+	// derived from Terraform's plan-time PlannedValues rather than real
+	// infrastructure. A role whose outputs a provider only assigns during
+	// Apply (node IPs on a first provision, for instance) keeps its values
+	// from the plan passed into Plan instead of failing the projection.
+	Projected *install.Plan
+	// Changed is false when Terraform reports no changes are needed
+	// (exit code 0 from `plan -detailed-exitcode`), in which case Apply is a no-op.
+	Changed bool
+
+	plan            install.Plan
+	clusterStateDir string
+	planFile        string
+	tf              *tfexec.Terraform
+}
+
+// ResourceCounts summarizes TFPlan by action, for callers that just want
+// added/changed/destroyed totals rather than the full per-resource diff.
+func (pp *ProvisionPlan) ResourceCounts() (added, changed, destroyed int) {
+	for _, rc := range pp.TFPlan.ResourceChanges {
+		switch {
+		case rc.Change.Actions.Create():
+			added++
+		case rc.Change.Actions.Delete():
+			destroyed++
+		case rc.Change.Actions.Update(), rc.Change.Actions.Replace():
+			changed++
+		}
+	}
+	return added, changed, destroyed
+}
+
+// Provision creates the infrastructure required to support the cluster defined
+// in the plan. It is equivalent to calling Plan followed by Apply.
+func (at AnyTerraform) Provision(plan install.Plan) (*install.Plan, error) {
+	pp, err := at.Plan(plan)
 	if err != nil {
 		return nil, err
 	}
+	return at.Apply(pp)
+}
+
+// Plan runs `terraform init` and `terraform plan` for the cluster defined in
+// plan, without applying anything, so that operators (or a CI pipeline) can
+// review the projected infrastructure changes before committing to them via
+// Apply.
+func (at AnyTerraform) Plan(plan install.Plan) (*ProvisionPlan, error) {
+	ctx := context.Background()
+	providerName := plan.Provisioner.Provider
+
+	var providerDir string
+	var p *provider
+	switch {
+	case plan.Provisioner.Source == install.Inline:
+		// Inline sources carry their own environment variable requirements,
+		// since there is no on-disk provider.yaml to read them from.
+		p = &provider{EnvironmentVariables: plan.Provisioner.Inline.EnvironmentVariables}
+	case plan.Provisioner.ModuleSource != "":
+		// Remote module addresses (git, S3, HTTP, ...) are fetched at init
+		// time with -from-module, so there is no on-disk provider.yaml to
+		// read environment variable requirements from either; the plan must
+		// declare them directly, same as Inline.
+		p = &provider{EnvironmentVariables: plan.Provisioner.ModuleEnvironmentVariables}
+	default:
+		providerDir = filepath.Join(at.ProvidersDir, providerName)
+		if _, err := os.Stat(providerDir); os.IsNotExist(err) {
+			return nil, fmt.Errorf("provider %q is not supported", providerName)
+		}
+		var err error
+		p, err = readProviderDescriptor(providerDir)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Create directory for keeping cluster state
 	clusterStateDir := filepath.Join(at.StateDir, plan.Cluster.Name)
@@ -87,26 +275,50 @@ func (at AnyTerraform) Provision(plan install.Plan) (*install.Plan, error) {
 
 	pubKeyPath := filepath.Join(clusterStateDir, fmt.Sprintf("%s-ssh.pub", plan.Cluster.Name))
 	privKeyPath := filepath.Join(clusterStateDir, fmt.Sprintf("%s-ssh.pem", plan.Cluster.Name))
-
-	var privKeyExists, pubKeyExists bool
-	if _, err := os.Stat(pubKeyPath); err == nil {
-		pubKeyExists = true
-	}
-	if _, err := os.Stat(privKeyPath); err == nil {
-		privKeyExists = true
-	}
-
-	if pubKeyExists != privKeyExists {
-		if !privKeyExists {
-			return nil, fmt.Errorf("found an existing public key at %s, but did not find the corresponding private key at %s. The corresponding key must be recovered if possible. Otherwise, the existing key must be deleted", pubKeyPath, privKeyPath)
+	pubKeyName := filepath.Base(pubKeyPath)
+	privKeyName := filepath.Base(privKeyPath)
+
+	// Fetch any key material a previous `kismatic apply` already stored, so
+	// that concurrent operators share one keypair instead of generating
+	// their own and locking each other out over SSH.
+	store := at.secretsStore()
+	pubKey, pubErr := store.Get(ctx, plan.Cluster.Name, pubKeyName)
+	privKey, privErr := store.Get(ctx, plan.Cluster.Name, privKeyName)
+	pubMissing := errors.Is(pubErr, os.ErrNotExist)
+	privMissing := errors.Is(privErr, os.ErrNotExist)
+
+	switch {
+	case pubErr == nil && privErr == nil:
+		if err := ioutil.WriteFile(pubKeyPath, pubKey, 0644); err != nil {
+			return nil, fmt.Errorf("error writing public key: %v", err)
 		}
-		return nil, fmt.Errorf("found an existing private key at %s, but did not find the corresponding public key at %s. The corresponding key must be recovered if possible. Otherwise, the existing key must be deleted", privKeyPath, pubKeyPath)
-	}
-
-	if !privKeyExists && !pubKeyExists {
+		if err := ioutil.WriteFile(privKeyPath, privKey, 0600); err != nil {
+			return nil, fmt.Errorf("error writing private key: %v", err)
+		}
+	case pubMissing && privMissing:
 		if err := ssh.NewKeyPair(pubKeyPath, privKeyPath); err != nil {
 			return nil, fmt.Errorf("error generating SSH key pair: %v", err)
 		}
+		pubBytes, err := ioutil.ReadFile(pubKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading generated public key: %v", err)
+		}
+		privBytes, err := ioutil.ReadFile(privKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading generated private key: %v", err)
+		}
+		if err := store.Put(ctx, plan.Cluster.Name, pubKeyName, pubBytes); err != nil {
+			return nil, fmt.Errorf("error storing public key: %v", err)
+		}
+		if err := store.Put(ctx, plan.Cluster.Name, privKeyName, privBytes); err != nil {
+			return nil, fmt.Errorf("error storing private key: %v", err)
+		}
+	case pubErr != nil && !pubMissing:
+		return nil, fmt.Errorf("error retrieving public key for cluster %q from the secrets store: %v", plan.Cluster.Name, pubErr)
+	case privErr != nil && !privMissing:
+		return nil, fmt.Errorf("error retrieving private key for cluster %q from the secrets store: %v", plan.Cluster.Name, privErr)
+	default:
+		return nil, fmt.Errorf("found only one half of the SSH keypair for cluster %q in the secrets store; the corresponding key must be recovered if possible, otherwise the remaining key must be deleted", plan.Cluster.Name)
 	}
 	plan.Cluster.SSH.Key = privKeyPath
 
@@ -147,146 +359,270 @@ func (at AnyTerraform) Provision(plan install.Plan) (*install.Plan, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not get secrets required for provisioning infrastructure: %v", err)
 	}
-	cmdEnv := append(baseTerraformCmdEnv(), secretEnvVars...)
-	cmdDir := clusterStateDir
 
-	// Terraform init
-	cmd := exec.Command(at.BinaryPath, "init", providerDir)
-	cmd.Env = cmdEnv
-	cmd.Dir = cmdDir
-	cmd.Stdout = at.Output
-	cmd.Stderr = at.Output
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("Error initializing terraform: %s", err)
+	if err := writeBackendConfig(clusterStateDir, plan.Cluster.Name, plan.Provisioner.Backend); err != nil {
+		return nil, err
 	}
 
-	// Terraform plan
-	cmd = exec.Command(at.BinaryPath, "plan", fmt.Sprintf("-out=%s", plan.Cluster.Name), providerDir)
-	cmd.Env = cmdEnv
-	cmd.Dir = cmdDir
-	cmd.Stdout = at.Output
-	cmd.Stderr = at.Output
+	tf, err := at.newTerraformClient(ctx, clusterStateDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := tf.SetEnv(cmdEnvMap(secretEnvVars)); err != nil {
+		return nil, fmt.Errorf("error setting terraform environment: %v", err)
+	}
+
+	initLog := at.initLogWriter()
+	tf.SetStdout(initLog)
+	tf.SetStderr(initLog)
+
+	at.hook().PreInit()
+	if plan.Provisioner.Source == install.Inline {
+		if err := writeInlineModule(clusterStateDir, plan.Provisioner.Inline); err != nil {
+			return nil, err
+		}
+		if err := tf.Init(ctx); err != nil {
+			return nil, fmt.Errorf("error initializing terraform: %v", err)
+		}
+	} else if plan.Provisioner.ModuleSource != "" {
+		// Remote module addresses (git, S3, HTTP, ...) beyond the on-disk
+		// providers directory are fetched with -from-module.
+		if err := tf.Init(ctx, tfexec.FromModule(plan.Provisioner.ModuleSource)); err != nil {
+			return nil, fmt.Errorf("error initializing terraform: %v", err)
+		}
+	} else {
+		if err := tf.Init(ctx, tfexec.Dir(providerDir)); err != nil {
+			return nil, fmt.Errorf("error initializing terraform: %v", err)
+		}
+	}
+	at.hook().PostInit()
+
+	at.hook().PrePlan()
+	planFile := plan.Cluster.Name
+	changed, err := tf.PlanJSON(ctx, at.jsonLogWriter(), tfexec.Out(planFile))
+	if err != nil {
+		return nil, fmt.Errorf("error running terraform plan: %v", err)
+	}
+
+	tfPlan, err := tf.ShowPlanFile(ctx, planFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading terraform plan: %v", err)
+	}
+	at.hook().PostPlan(tfPlan)
+
+	return &ProvisionPlan{
+		TFPlan:          tfPlan,
+		Projected:       at.projectPlan(plan, tfPlan),
+		Changed:         changed,
+		plan:            plan,
+		clusterStateDir: clusterStateDir,
+		planFile:        planFile,
+		tf:              tf,
+	}, nil
+}
+
+// projectPlan derives the install.Plan that TFPlan would produce if applied,
+// reusing the same getTerraformNodes/getLoadBalancer/getBastion extraction
+// Apply uses against a real `terraform show`, but against TFPlan's
+// PlannedValues instead. Unlike buildPopulatedPlan, a role whose attributes
+// Terraform can't resolve until Apply is left unchanged rather than treated
+// as an error, since that's expected for any resource being created.
+//
+// CLI exposure (a `kismatic provision plan` command rendering this diff) is
+// not part of this package; it belongs in cmd/kismatic alongside the rest of
+// the CLI and isn't implemented here.
+func (at AnyTerraform) projectPlan(plan install.Plan, tfPlan *tfjson.Plan) *install.Plan {
+	projected := plan
+	if tfPlan.PlannedValues == nil {
+		return &projected
+	}
+	state := &tfjson.State{Values: tfPlan.PlannedValues}
+
+	if tfNodes, err := at.getTerraformNodes(state, "master"); err == nil {
+		masterNodes := nodeGroupFromSlices(tfNodes.IPs, tfNodes.InternalIPs, tfNodes.Hosts)
+		projected.Master = install.MasterNodeGroup{
+			ExpectedCount: masterNodes.ExpectedCount,
+			Nodes:         masterNodes.Nodes,
+		}
+		if external, internal, err := at.getLoadBalancer(state, "master"); err == nil {
+			projected.Master.LoadBalancedFQDN = external
+			projected.Master.LoadBalancedShortName = external
+			projected.Master.InternalLoadBalancedFQDN = internal
+		}
+	}
+	if bastion, err := at.getBastion(state); err == nil && bastion != nil {
+		projected.Bastion = *bastion
+	}
+	if tfNodes, err := at.getTerraformNodes(state, "etcd"); err == nil {
+		projected.Etcd = nodeGroupFromSlices(tfNodes.IPs, tfNodes.InternalIPs, tfNodes.Hosts)
+	}
+	if tfNodes, err := at.getTerraformNodes(state, "worker"); err == nil {
+		projected.Worker = nodeGroupFromSlices(tfNodes.IPs, tfNodes.InternalIPs, tfNodes.Hosts)
+	}
+	if plan.Ingress.ExpectedCount > 0 {
+		if tfNodes, err := at.getTerraformNodes(state, "ingress"); err == nil {
+			projected.Ingress = install.OptionalNodeGroup(nodeGroupFromSlices(tfNodes.IPs, tfNodes.InternalIPs, tfNodes.Hosts))
+		}
+	}
+	if plan.Storage.ExpectedCount > 0 {
+		if tfNodes, err := at.getTerraformNodes(state, "storage"); err == nil {
+			projected.Storage = install.OptionalNodeGroup(nodeGroupFromSlices(tfNodes.IPs, tfNodes.InternalIPs, tfNodes.Hosts))
+		}
+	}
+	return &projected
+}
 
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("Error running terraform plan: %s", err)
+// Apply runs `terraform apply` against a plan produced by Plan, then reads
+// the resulting infrastructure back into an updated install.Plan.
+func (at AnyTerraform) Apply(pp *ProvisionPlan) (*install.Plan, error) {
+	ctx := context.Background()
+	if !pp.Changed {
+		provisionedPlan, err := at.buildPopulatedPlan(ctx, pp.tf, pp.plan)
+		if err != nil {
+			return nil, err
+		}
+		return provisionedPlan, nil
 	}
 
-	// Terraform apply
-	cmd = exec.Command(at.BinaryPath, "apply", "-input=false", plan.Cluster.Name)
-	cmd.Stdout = at.Output
-	cmd.Stderr = at.Output
-	cmd.Env = cmdEnv
-	cmd.Dir = cmdDir
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("Error running terraform apply: %s", err)
+	at.hook().PreApply()
+	if err := pp.tf.ApplyJSON(ctx, at.jsonLogWriter(), tfexec.DirOrPlan(pp.planFile)); err != nil {
+		return nil, fmt.Errorf("error running terraform apply: %v", err)
 	}
+	at.hook().PostApply()
 
 	// Update plan with data from provider
-	provisionedPlan, err := at.buildPopulatedPlan(plan)
+	provisionedPlan, err := at.buildPopulatedPlan(ctx, pp.tf, pp.plan)
 	if err != nil {
 		return nil, err
 	}
 	return provisionedPlan, nil
 }
 
-// Destroy tears down the cluster and infrastructure defined in the plan file
-func (at AnyTerraform) Destroy(provider, clusterName string) error {
-	providerDir := filepath.Join(at.ProvidersDir, provider)
+// Destroy tears down the cluster and infrastructure defined in the plan file.
+// It takes the same install.Plan as Provision (rather than just a provider
+// and cluster name) so that it can render the same backend.tf and acquire
+// the same remote state lock Provision used, instead of risking a fall back
+// to local state that another operator isn't watching.
+func (at AnyTerraform) Destroy(plan install.Plan) error {
+	ctx := context.Background()
+	providerDir := filepath.Join(at.ProvidersDir, plan.Provisioner.Provider)
 	p, err := readProviderDescriptor(providerDir)
 	if err != nil {
 		return err
 	}
 
-	secretEnvVars, err := at.SecretsGetter.GetAsEnvironmentVariables(clusterName, p.EnvironmentVariables)
+	secretEnvVars, err := at.SecretsGetter.GetAsEnvironmentVariables(plan.Cluster.Name, p.EnvironmentVariables)
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command(at.BinaryPath, "destroy", "-force")
-	cmd.Stdout = at.Output
-	cmd.Stderr = at.Output
-	cmd.Env = append(baseTerraformCmdEnv(), secretEnvVars...)
-	cmd.Dir = filepath.Join(at.StateDir, clusterName)
+	clusterStateDir := filepath.Join(at.StateDir, plan.Cluster.Name)
+	if err := writeBackendConfig(clusterStateDir, plan.Cluster.Name, plan.Provisioner.Backend); err != nil {
+		return err
+	}
+
+	tf, err := at.newTerraformClient(ctx, clusterStateDir)
 	if err != nil {
 		return err
 	}
-	if err := cmd.Run(); err != nil {
-		return errors.New("Error destroying infrastructure with Terraform")
+	if err := tf.SetEnv(cmdEnvMap(secretEnvVars)); err != nil {
+		return fmt.Errorf("error setting terraform environment: %v", err)
+	}
+
+	at.hook().PreDestroy()
+	if err := tf.DestroyJSON(ctx, at.jsonLogWriter()); err != nil {
+		return fmt.Errorf("error destroying infrastructure with terraform: %v", err)
 	}
+	at.hook().PostDestroy()
 	return nil
 }
 
-func baseTerraformCmdEnv() []string {
-	return append(os.Environ(), "TF_IN_AUTOMATION=True")
+// cmdEnvMap converts the "KEY=VALUE" slice produced by SecretsGetter into the
+// map tfexec.SetEnv expects, inheriting the provisioning process's own
+// environment. TF_IN_AUTOMATION is deliberately not set here: tfexec already
+// forces it on every command it runs, and SetEnv rejects a caller trying to
+// set it explicitly.
+func cmdEnvMap(secretEnvVars []string) map[string]string {
+	env := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v := splitEnv(kv)
+		env[k] = v
+	}
+	for _, kv := range secretEnvVars {
+		k, v := splitEnv(kv)
+		env[k] = v
+	}
+	return env
 }
 
-func (at AnyTerraform) getLoadBalancer(clusterName, lbName string) (string, error) {
-	tfOutLB := fmt.Sprintf("%s_lb", lbName)
-	cmdDir := filepath.Join(at.StateDir, clusterName)
+func splitEnv(kv string) (string, string) {
+	for i := 0; i < len(kv); i++ {
+		if kv[i] == '=' {
+			return kv[:i], kv[i+1:]
+		}
+	}
+	return kv, ""
+}
 
-	//load balancer
-	tfCmdOutputLB := exec.Command(at.BinaryPath, "output", "-json", tfOutLB)
-	tfCmdOutputLB.Dir = cmdDir
-	stdoutStderrLB, err := tfCmdOutputLB.CombinedOutput()
+// getLoadBalancer returns the external and (if the provider exposes one)
+// internal load balancer address for lbName. Internal load balancers support
+// private-cluster topologies where the API endpoint isn't reachable from the
+// public internet; internal is "" when the provider output is absent.
+func (at AnyTerraform) getLoadBalancer(state *tfjson.State, lbName string) (external, internal string, err error) {
+	externalValues, err := stringSliceOutput(state, fmt.Sprintf("%s_lb_external", lbName))
 	if err != nil {
-		return "", fmt.Errorf("Error collecting terraform output: %s", stdoutStderrLB)
+		return "", "", err
 	}
-	lbData := tfOutputVar{}
-	if err := json.Unmarshal(stdoutStderrLB, &lbData); err != nil {
-		return "", err
+	if len(externalValues) != 1 {
+		return "", "", fmt.Errorf("Expect to get 1 load balancer, but got %d", len(externalValues))
 	}
-	if len(lbData.Value) != 1 {
-		return "", fmt.Errorf("Expect to get 1 load balancer, but got %d", len(lbData.Value))
+
+	internalValues, _ := stringSliceOutput(state, fmt.Sprintf("%s_lb_internal", lbName))
+	if len(internalValues) == 1 {
+		internal = internalValues[0]
 	}
-	return lbData.Value[0], nil
+
+	return externalValues[0], internal, nil
 }
 
-func (at AnyTerraform) getTerraformNodes(clusterName, role string) (*tfNodeGroup, error) {
-	tfOutPubIPs := fmt.Sprintf("%s_pub_ips", role)
-	tfOutPrivIPs := fmt.Sprintf("%s_priv_ips", role)
-	tfOutHosts := fmt.Sprintf("%s_hosts", role)
-	cmdDir := filepath.Join(at.StateDir, clusterName)
+// getBastion returns the bastion/jump host for the cluster, or nil if the
+// provider does not expose one. Clusters with no public API endpoint and
+// workers on private subnets only rely on this to reach nodes over SSH.
+func (at AnyTerraform) getBastion(state *tfjson.State) (*install.Node, error) {
+	host, hostOK := stringOutput(state, "bastion_host")
+	if !hostOK {
+		return nil, nil
+	}
+	pubIP, _ := stringOutput(state, "bastion_pub_ip")
+	privIP, _ := stringOutput(state, "bastion_priv_ip")
+
+	return &install.Node{
+		Host:       host,
+		IP:         pubIP,
+		InternalIP: privIP,
+	}, nil
+}
 
+func (at AnyTerraform) getTerraformNodes(state *tfjson.State, role string) (*tfNodeGroup, error) {
 	nodes := &tfNodeGroup{}
 
-	//Public IPs
-	tfCmdOutputPub := exec.Command(at.BinaryPath, "output", "-json", tfOutPubIPs)
-	tfCmdOutputPub.Dir = cmdDir
-	stdoutStderrPub, err := tfCmdOutputPub.CombinedOutput()
+	pubIPs, err := stringSliceOutput(state, fmt.Sprintf("%s_pub_ips", role))
 	if err != nil {
-		return nil, fmt.Errorf("Error collecting terraform output: %s", stdoutStderrPub)
-	}
-	pubIPData := tfOutputVar{}
-	if err := json.Unmarshal(stdoutStderrPub, &pubIPData); err != nil {
 		return nil, err
 	}
-	nodes.IPs = pubIPData.Value
+	nodes.IPs = pubIPs
 
-	//Private IPs
-	tfCmdOutputPriv := exec.Command(at.BinaryPath, "output", "-json", tfOutPrivIPs)
-	tfCmdOutputPriv.Dir = cmdDir
-	stdoutStderrPriv, err := tfCmdOutputPriv.CombinedOutput()
+	privIPs, err := stringSliceOutput(state, fmt.Sprintf("%s_priv_ips", role))
 	if err != nil {
-		return nil, fmt.Errorf("Error collecting terraform output: %s", stdoutStderrPriv)
-	}
-	privIPData := tfOutputVar{}
-	if err := json.Unmarshal(stdoutStderrPriv, &privIPData); err != nil {
 		return nil, err
 	}
-	nodes.InternalIPs = privIPData.Value
+	nodes.InternalIPs = privIPs
 
-	//Hosts
-	tfCmdOutputHost := exec.Command(at.BinaryPath, "output", "-json", tfOutHosts)
-	tfCmdOutputHost.Dir = cmdDir
-	stdoutStderrHost, err := tfCmdOutputHost.CombinedOutput()
+	hosts, err := stringSliceOutput(state, fmt.Sprintf("%s_hosts", role))
 	if err != nil {
-		return nil, fmt.Errorf("Error collecting terraform output: %s", stdoutStderrHost)
-	}
-	hostData := tfOutputVar{}
-	if err := json.Unmarshal(stdoutStderrHost, &hostData); err != nil {
 		return nil, err
 	}
-	nodes.Hosts = hostData.Value
+	nodes.Hosts = hosts
 
 	if len(nodes.IPs) != len(nodes.Hosts) {
 		return nil, fmt.Errorf("Expected to get %d host names, but got %d", len(nodes.IPs), len(nodes.Hosts))
@@ -300,6 +636,49 @@ func (at AnyTerraform) getTerraformNodes(clusterName, role string) (*tfNodeGroup
 	return nodes, nil
 }
 
+// stringSliceOutput extracts a []string-typed output named name from a single
+// `terraform show -json` state, replacing the old one-output-per-exec calls.
+func stringSliceOutput(state *tfjson.State, name string) ([]string, error) {
+	if state.Values == nil || state.Values.Outputs == nil {
+		return nil, fmt.Errorf("terraform state has no outputs")
+	}
+	out, ok := state.Values.Outputs[name]
+	if !ok {
+		return nil, fmt.Errorf("terraform output %q was not found", name)
+	}
+	raw, ok := out.Value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("terraform output %q is not a list", name)
+	}
+	values := make([]string, 0, len(raw))
+	for _, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("terraform output %q contains a non-string value", name)
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
+
+// stringOutput extracts a string-typed output named name, returning ok=false
+// when the output isn't present rather than an error, since bastion outputs
+// are optional depending on the provider.
+func stringOutput(state *tfjson.State, name string) (value string, ok bool) {
+	if state.Values == nil || state.Values.Outputs == nil {
+		return "", false
+	}
+	out, present := state.Values.Outputs[name]
+	if !present {
+		return "", false
+	}
+	s, isString := out.Value.(string)
+	if !isString {
+		return "", false
+	}
+	return s, true
+}
+
 func (at AnyTerraform) getClusterStateDir(clusterName string) (string, error) {
 	path, err := os.Getwd()
 	if err != nil {
@@ -325,10 +704,17 @@ func nodeGroupFromSlices(ips, internalIPs, hosts []string) install.NodeGroup {
 	return ng
 }
 
-// updatePlan
-func (at AnyTerraform) buildPopulatedPlan(plan install.Plan) (*install.Plan, error) {
+// buildPopulatedPlan reads every role's nodes, the master load balancer, and the
+// bastion host from a single `terraform show -json` state, rather than
+// shelling out to Terraform once per piece of information.
+func (at AnyTerraform) buildPopulatedPlan(ctx context.Context, tf *tfexec.Terraform, plan install.Plan) (*install.Plan, error) {
+	state, err := tf.Show(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error collecting terraform output: %v", err)
+	}
+
 	// Masters
-	tfNodes, err := at.getTerraformNodes(plan.Cluster.Name, "master")
+	tfNodes, err := at.getTerraformNodes(state, "master")
 	if err != nil {
 		return nil, err
 	}
@@ -337,23 +723,32 @@ func (at AnyTerraform) buildPopulatedPlan(plan install.Plan) (*install.Plan, err
 		ExpectedCount: masterNodes.ExpectedCount,
 		Nodes:         masterNodes.Nodes,
 	}
-	mlb, err := at.getLoadBalancer(plan.Cluster.Name, "master")
+	mlbExternal, mlbInternal, err := at.getLoadBalancer(state, "master")
 	if err != nil {
 		return nil, err
 	}
-	mng.LoadBalancedFQDN = mlb
-	mng.LoadBalancedShortName = mlb
+	mng.LoadBalancedFQDN = mlbExternal
+	mng.LoadBalancedShortName = mlbExternal
+	mng.InternalLoadBalancedFQDN = mlbInternal
 	plan.Master = mng
 
+	bastion, err := at.getBastion(state)
+	if err != nil {
+		return nil, err
+	}
+	if bastion != nil {
+		plan.Bastion = *bastion
+	}
+
 	// Etcds
-	tfNodes, err = at.getTerraformNodes(plan.Cluster.Name, "etcd")
+	tfNodes, err = at.getTerraformNodes(state, "etcd")
 	if err != nil {
 		return nil, err
 	}
 	plan.Etcd = nodeGroupFromSlices(tfNodes.IPs, tfNodes.InternalIPs, tfNodes.Hosts)
 
 	// Workers
-	tfNodes, err = at.getTerraformNodes(plan.Cluster.Name, "worker")
+	tfNodes, err = at.getTerraformNodes(state, "worker")
 	if err != nil {
 		return nil, err
 	}
@@ -361,7 +756,7 @@ func (at AnyTerraform) buildPopulatedPlan(plan install.Plan) (*install.Plan, err
 
 	// Ingress
 	if plan.Ingress.ExpectedCount > 0 {
-		tfNodes, err = at.getTerraformNodes(plan.Cluster.Name, "ingress")
+		tfNodes, err = at.getTerraformNodes(state, "ingress")
 		if err != nil {
 			return nil, fmt.Errorf("error getting ingress node information: %v", err)
 		}
@@ -370,7 +765,7 @@ func (at AnyTerraform) buildPopulatedPlan(plan install.Plan) (*install.Plan, err
 
 	// Storage
 	if plan.Storage.ExpectedCount > 0 {
-		tfNodes, err = at.getTerraformNodes(plan.Cluster.Name, "storage")
+		tfNodes, err = at.getTerraformNodes(state, "storage")
 		if err != nil {
 			return nil, fmt.Errorf("error getting storage node information: %v", err)
 		}
@@ -378,4 +773,4 @@ func (at AnyTerraform) buildPopulatedPlan(plan install.Plan) (*install.Plan, err
 	}
 
 	return &plan, nil
-}
\ No newline at end of file
+}